@@ -11,30 +11,36 @@ import (
 	"github.com/containous/traefik/v2/pkg/log"
 	"github.com/containous/traefik/v2/pkg/provider"
 	"github.com/containous/traefik/v2/pkg/provider/constraints"
-	"github.com/hashicorp/consul/api"
 )
 
+// serviceClusterLabel optionally groups several Consul service names under
+// a single logical service, so that, e.g., a canary deployment registered
+// under its own name can still be load balanced alongside the stable one.
+const serviceClusterLabel = "traefik.consulcatalog.serviceCluster"
+
 func (p *Provider) buildConfiguration(ctx context.Context, items []itemData) *dynamic.Configuration {
 	configurations := make(map[string]*dynamic.Configuration)
 
-	for _, item := range items {
-		svcName := item.Node + "-" + item.Name + "-" + item.ID
+	for svcName, group := range groupItemsByService(items) {
 		ctxSvc := log.With(ctx, log.Str("serviceName", svcName))
 
-		if !p.keepContainer(ctxSvc, item) {
+		kept := p.keepGroup(ctxSvc, group)
+		if len(kept) == 0 {
 			continue
 		}
 
 		logger := log.FromContext(ctxSvc)
 
-		confFromLabel, err := label.DecodeConfiguration(item.Labels)
+		primary := kept[0]
+
+		confFromLabel, err := label.DecodeConfiguration(primary.Labels)
 		if err != nil {
 			logger.Error(err)
 			continue
 		}
 
 		if len(confFromLabel.TCP.Routers) > 0 || len(confFromLabel.TCP.Services) > 0 {
-			err := p.buildTCPServiceConfiguration(ctxSvc, item, confFromLabel.TCP)
+			err := p.buildTCPServiceConfiguration(ctxSvc, svcName, kept, confFromLabel.TCP)
 			if err != nil {
 				logger.Error(err)
 				continue
@@ -50,7 +56,7 @@ func (p *Provider) buildConfiguration(ctx context.Context, items []itemData) *dy
 			}
 		}
 
-		err = p.buildServiceConfiguration(ctxSvc, item, confFromLabel.HTTP)
+		err = p.buildServiceConfiguration(ctxSvc, svcName, kept, confFromLabel.HTTP)
 		if err != nil {
 			logger.Error(err)
 			continue
@@ -60,11 +66,11 @@ func (p *Provider) buildConfiguration(ctx context.Context, items []itemData) *dy
 			Name   string
 			Labels map[string]string
 		}{
-			Name:   item.Name,
-			Labels: item.Labels,
+			Name:   primary.Name,
+			Labels: primary.Labels,
 		}
 
-		provider.BuildRouterConfiguration(ctx, confFromLabel.HTTP, item.Name, p.defaultRuleTpl, model)
+		provider.BuildRouterConfiguration(ctx, confFromLabel.HTTP, primary.Name, p.defaultRuleTpl, model)
 
 		configurations[svcName] = confFromLabel
 	}
@@ -72,6 +78,39 @@ func (p *Provider) buildConfiguration(ctx context.Context, items []itemData) *dy
 	return provider.Merge(ctx, configurations)
 }
 
+// groupItemsByService aggregates the instances of a logical service -
+// same Consul service name, or same serviceClusterLabel override - so
+// that they can be load balanced as a single dynamic.Service.
+func groupItemsByService(items []itemData) map[string][]itemData {
+	groups := make(map[string][]itemData)
+	for _, item := range items {
+		key := serviceGroupKey(item)
+		groups[key] = append(groups[key], item)
+	}
+
+	return groups
+}
+
+func serviceGroupKey(item itemData) string {
+	if cluster := item.Labels[serviceClusterLabel]; cluster != "" {
+		return cluster
+	}
+
+	return item.Name
+}
+
+// keepGroup filters out the instances of group that keepContainer rejects.
+func (p *Provider) keepGroup(ctx context.Context, group []itemData) []itemData {
+	kept := make([]itemData, 0, len(group))
+	for _, item := range group {
+		if p.keepContainer(ctx, item) {
+			kept = append(kept, item)
+		}
+	}
+
+	return kept
+}
+
 func (p *Provider) keepContainer(ctx context.Context, item itemData) bool {
 	logger := log.FromContext(ctx)
 
@@ -90,29 +129,38 @@ func (p *Provider) keepContainer(ctx context.Context, item itemData) bool {
 		return false
 	}
 
-	if item.Status != api.HealthPassing && item.Status != api.HealthWarning {
-		logger.Debug("Filtering unhealthy or starting item")
+	if !acceptHealthStatus(item.Status, p.warningPolicy()) {
+		logger.Debugf("Filtering item in status %q", item.Status)
 		return false
 	}
 
 	return true
 }
 
-func (p *Provider) buildTCPServiceConfiguration(ctx context.Context, item itemData, configuration *dynamic.TCPConfiguration) error {
+func (p *Provider) buildTCPServiceConfiguration(ctx context.Context, defaultName string, group []itemData, configuration *dynamic.TCPConfiguration) error {
 	if len(configuration.Services) == 0 {
 		configuration.Services = make(map[string]*dynamic.TCPService)
 
 		lb := &dynamic.TCPServersLoadBalancer{}
 		lb.SetDefaults()
 
-		configuration.Services[item.Name] = &dynamic.TCPService{
+		configuration.Services[defaultName] = &dynamic.TCPService{
 			LoadBalancer: lb,
 		}
 	}
 
+	// addServersTCP may insert new per-instance entries into
+	// configuration.Services when group's weights aren't uniform.
+	// Snapshot the label-declared services up front so that range below
+	// doesn't also visit those freshly inserted entries.
+	declared := make([]namedTCPService, 0, len(configuration.Services))
 	for name, service := range configuration.Services {
-		ctxSvc := log.With(ctx, log.Str(log.ServiceName, name))
-		err := p.addServerTCP(ctxSvc, item, service.LoadBalancer)
+		declared = append(declared, namedTCPService{name: name, service: service})
+	}
+
+	for _, ns := range declared {
+		ctxSvc := log.With(ctx, log.Str(log.ServiceName, ns.name))
+		err := p.addServersTCP(ctxSvc, ns.name, group, configuration, ns.service)
 		if err != nil {
 			return err
 		}
@@ -121,21 +169,54 @@ func (p *Provider) buildTCPServiceConfiguration(ctx context.Context, item itemDa
 	return nil
 }
 
-func (p *Provider) buildServiceConfiguration(ctx context.Context, item itemData, configuration *dynamic.HTTPConfiguration) error {
+type namedTCPService struct {
+	name    string
+	service *dynamic.TCPService
+}
+
+// resolveServerAddress returns the address and port a server should dial
+// for item, redirecting to the Connect sidecar proxy when item is
+// Connect-enabled. The returned bool reports whether the Connect proxy was
+// actually resolved: on lookup failure it falls back to the plain service
+// address, and callers must not wire up mTLS against that fallback.
+func (p *Provider) resolveServerAddress(ctx context.Context, item itemData) (string, string, bool, error) {
+	if !p.connectEnabled(item) {
+		return item.Address, item.Port, false, nil
+	}
+
+	address, port, err := p.connectProxyAddress(item)
+	if err != nil {
+		log.FromContext(ctx).Errorf("Falling back to the service address, connect proxy lookup failed: %v", err)
+		return item.Address, item.Port, false, nil
+	}
+
+	return address, port, true, nil
+}
+
+func (p *Provider) buildServiceConfiguration(ctx context.Context, defaultName string, group []itemData, configuration *dynamic.HTTPConfiguration) error {
 	if len(configuration.Services) == 0 {
 		configuration.Services = make(map[string]*dynamic.Service)
 
 		lb := &dynamic.ServersLoadBalancer{}
 		lb.SetDefaults()
 
-		configuration.Services[item.Name] = &dynamic.Service{
+		configuration.Services[defaultName] = &dynamic.Service{
 			LoadBalancer: lb,
 		}
 	}
 
+	// addServers may insert new per-instance entries into
+	// configuration.Services when group's weights aren't uniform.
+	// Snapshot the label-declared services up front so that range below
+	// doesn't also visit those freshly inserted entries.
+	declared := make([]namedService, 0, len(configuration.Services))
 	for name, service := range configuration.Services {
-		ctxSvc := log.With(ctx, log.Str(log.ServiceName, name))
-		err := p.addServer(ctxSvc, item, service.LoadBalancer)
+		declared = append(declared, namedService{name: name, service: service})
+	}
+
+	for _, ns := range declared {
+		ctxSvc := log.With(ctx, log.Str(log.ServiceName, ns.name))
+		err := p.addServers(ctxSvc, ns.name, group, configuration, ns.service)
 		if err != nil {
 			return err
 		}
@@ -144,65 +225,221 @@ func (p *Provider) buildServiceConfiguration(ctx context.Context, item itemData,
 	return nil
 }
 
-func (p *Provider) addServerTCP(ctx context.Context, item itemData, loadBalancer *dynamic.TCPServersLoadBalancer) error {
-	if loadBalancer == nil {
+type namedService struct {
+	name    string
+	service *dynamic.Service
+}
+
+// addServersTCP builds one TCP server per instance in group. If the
+// instances don't all carry the same weight, the named service is turned
+// into a dynamic.TCPWeightedRoundRobin referencing one sub-service per
+// instance instead of a plain load balancer.
+func (p *Provider) addServersTCP(ctx context.Context, name string, group []itemData, configuration *dynamic.TCPConfiguration, service *dynamic.TCPService) error {
+	if service.LoadBalancer == nil {
 		return errors.New("load-balancer is not defined")
 	}
 
-	if len(loadBalancer.Servers) == 0 {
-		loadBalancer.Servers = []dynamic.TCPServer{{}}
+	logger := log.FromContext(ctx)
+
+	if uniformWeight(p, group) {
+		servers := make([]dynamic.TCPServer, 0, len(group))
+		for _, item := range group {
+			server, err := p.buildServerTCP(ctx, item, service.LoadBalancer)
+			if err != nil {
+				logger.Errorf("Skipping instance %s: %v", instanceKey(item), err)
+				continue
+			}
+			servers = append(servers, server)
+		}
+
+		service.LoadBalancer.Servers = servers
+		return nil
 	}
 
-	var port string
-	if item.Port != "" {
-		port = item.Port
-		loadBalancer.Servers[0].Port = ""
+	wrr := &dynamic.TCPWeightedRoundRobin{}
+
+	for _, item := range group {
+		lb := &dynamic.TCPServersLoadBalancer{}
+		lb.SetDefaults()
+
+		// Seed the per-instance load balancer with the label-declared
+		// server, so buildServerTCP inherits the same fields it would in
+		// the uniform-weight branch instead of starting from a bare
+		// dynamic.TCPServer{}.
+		if len(service.LoadBalancer.Servers) > 0 {
+			lb.Servers = []dynamic.TCPServer{service.LoadBalancer.Servers[0]}
+		}
+
+		server, err := p.buildServerTCP(ctx, item, lb)
+		if err != nil {
+			logger.Errorf("Skipping instance %s: %v", instanceKey(item), err)
+			continue
+		}
+		lb.Servers = []dynamic.TCPServer{server}
+
+		instanceName := name + "-" + instanceKey(item)
+		configuration.Services[instanceName] = &dynamic.TCPService{LoadBalancer: lb}
+
+		weight := p.serverWeight(item)
+		wrr.Services = append(wrr.Services, dynamic.TCPWRRService{Name: instanceName, Weight: &weight})
 	}
 
-	if port == "" {
-		return errors.New("port is missing")
+	configuration.Services[name] = &dynamic.TCPService{Weighted: wrr}
+
+	return nil
+}
+
+// addServers builds one server per instance in group. If the instances
+// don't all carry the same weight, the named service is turned into a
+// dynamic.WeightedRoundRobin referencing one sub-service per instance
+// instead of a plain load balancer.
+func (p *Provider) addServers(ctx context.Context, name string, group []itemData, configuration *dynamic.HTTPConfiguration, service *dynamic.Service) error {
+	if service.LoadBalancer == nil {
+		return errors.New("load-balancer is not defined")
 	}
 
-	if item.Address == "" {
-		return errors.New("address is missing")
+	logger := log.FromContext(ctx)
+
+	if uniformWeight(p, group) {
+		servers := make([]dynamic.Server, 0, len(group))
+		for _, item := range group {
+			server, err := p.buildServer(ctx, item, configuration, service.LoadBalancer)
+			if err != nil {
+				logger.Errorf("Skipping instance %s: %v", instanceKey(item), err)
+				continue
+			}
+			servers = append(servers, server)
+		}
+
+		service.LoadBalancer.Servers = servers
+		return nil
 	}
 
-	loadBalancer.Servers[0].Address = net.JoinHostPort(item.Address, port)
+	wrr := &dynamic.WeightedRoundRobin{}
+
+	for _, item := range group {
+		lb := &dynamic.ServersLoadBalancer{}
+		lb.SetDefaults()
+
+		// Seed the per-instance load balancer with the label-declared
+		// server, so buildServer inherits the same fields it would in the
+		// uniform-weight branch instead of starting from a bare
+		// dynamic.Server{}.
+		if len(service.LoadBalancer.Servers) > 0 {
+			lb.Servers = []dynamic.Server{service.LoadBalancer.Servers[0]}
+		}
+
+		server, err := p.buildServer(ctx, item, configuration, lb)
+		if err != nil {
+			logger.Errorf("Skipping instance %s: %v", instanceKey(item), err)
+			continue
+		}
+		lb.Servers = []dynamic.Server{server}
+
+		instanceName := name + "-" + instanceKey(item)
+		configuration.Services[instanceName] = &dynamic.Service{LoadBalancer: lb}
+
+		weight := p.serverWeight(item)
+		wrr.Services = append(wrr.Services, dynamic.WRRService{Name: instanceName, Weight: &weight})
+	}
+
+	configuration.Services[name] = &dynamic.Service{Weighted: wrr}
+
 	return nil
 }
 
-func (p *Provider) addServer(ctx context.Context, item itemData, loadBalancer *dynamic.ServersLoadBalancer) error {
-	if loadBalancer == nil {
-		return errors.New("load-balancer is not defined")
+// uniformWeight reports whether every instance in group carries the same
+// load-balancing weight, in which case a plain load balancer is enough and
+// there is no need for a WeightedRoundRobin service.
+func uniformWeight(p *Provider, group []itemData) bool {
+	reference := p.serverWeight(group[0])
+	for _, item := range group[1:] {
+		if p.serverWeight(item) != reference {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (p *Provider) buildServerTCP(ctx context.Context, item itemData, loadBalancer *dynamic.TCPServersLoadBalancer) (dynamic.TCPServer, error) {
+	server := dynamic.TCPServer{}
+	if len(loadBalancer.Servers) > 0 {
+		server = loadBalancer.Servers[0]
+	}
+
+	address, port, _, err := p.resolveServerAddress(ctx, item)
+	if err != nil {
+		return dynamic.TCPServer{}, err
+	}
+
+	if port == "" {
+		port = server.Port
+	}
+
+	if port == "" {
+		return dynamic.TCPServer{}, errors.New("port is missing")
+	}
+
+	if address == "" {
+		return dynamic.TCPServer{}, errors.New("address is missing")
 	}
 
-	var port string
+	server.Port = ""
+	server.Address = net.JoinHostPort(address, port)
+
+	return server, nil
+}
+
+func (p *Provider) buildServer(ctx context.Context, item itemData, configuration *dynamic.HTTPConfiguration, loadBalancer *dynamic.ServersLoadBalancer) (dynamic.Server, error) {
+	server := dynamic.Server{}
+	server.SetDefaults()
 	if len(loadBalancer.Servers) > 0 {
-		port = loadBalancer.Servers[0].Port
+		server = loadBalancer.Servers[0]
 	}
 
-	if len(loadBalancer.Servers) == 0 {
-		server := dynamic.Server{}
-		server.SetDefaults()
+	port := server.Port
 
-		loadBalancer.Servers = []dynamic.Server{server}
+	address, resolvedPort, usedConnectProxy, err := p.resolveServerAddress(ctx, item)
+	if err != nil {
+		return dynamic.Server{}, err
 	}
 
-	if item.Port != "" {
-		port = item.Port
-		loadBalancer.Servers[0].Port = ""
+	if resolvedPort != "" {
+		port = resolvedPort
 	}
 
 	if port == "" {
-		return errors.New("port is missing")
+		return dynamic.Server{}, errors.New("port is missing")
 	}
 
-	if item.Address == "" {
-		return errors.New("address is missing")
+	if address == "" {
+		return dynamic.Server{}, errors.New("address is missing")
 	}
 
-	loadBalancer.Servers[0].URL = fmt.Sprintf("%s://%s", loadBalancer.Servers[0].Scheme, net.JoinHostPort(item.Address, port))
-	loadBalancer.Servers[0].Scheme = ""
+	scheme := server.Scheme
+	server.Scheme = ""
+	server.Port = ""
 
-	return nil
+	// Only wire up mTLS when the Connect proxy was actually resolved: if
+	// resolveServerAddress fell back to the plain service address, sending
+	// an mTLS request at it would just be a broken server.
+	if p.connectEnabled(item) && usedConnectProxy {
+		transportName, transport, err := p.buildConnectTransport(ctx, item)
+		if err != nil {
+			return dynamic.Server{}, fmt.Errorf("building connect transport: %w", err)
+		}
+
+		if configuration.ServersTransports == nil {
+			configuration.ServersTransports = make(map[string]*dynamic.ServersTransport)
+		}
+		configuration.ServersTransports[transportName] = transport
+
+		loadBalancer.ServersTransport = transportName
+		scheme = "https"
+	}
+
+	server.URL = fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(address, port))
+
+	return server, nil
 }
@@ -0,0 +1,137 @@
+package consulcatalog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/containous/traefik/v2/pkg/config/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_serviceGroupKey(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		item     itemData
+		expected string
+	}{
+		{
+			desc:     "no serviceCluster label uses the Consul service name",
+			item:     itemData{Name: "app"},
+			expected: "app",
+		},
+		{
+			desc:     "serviceCluster label overrides the service name",
+			item:     itemData{Name: "app-canary", Labels: map[string]string{serviceClusterLabel: "app"}},
+			expected: "app",
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := serviceGroupKey(test.item)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_addServers_weighted(t *testing.T) {
+	group := []itemData{
+		{Name: "app", Node: "node1", ID: "app-1", Address: "10.0.0.1", Port: "80", Meta: map[string]string{weightMetaKey: "50"}},
+		{Name: "app", Node: "node2", ID: "app-2", Address: "10.0.0.2", Port: "80", Meta: map[string]string{weightMetaKey: "10"}},
+	}
+
+	configuration := &dynamic.HTTPConfiguration{
+		Services: map[string]*dynamic.Service{
+			"app": {
+				LoadBalancer: &dynamic.ServersLoadBalancer{
+					Servers: []dynamic.Server{{Scheme: "https"}},
+				},
+			},
+		},
+	}
+
+	p := &Provider{}
+
+	err := p.buildServiceConfiguration(context.Background(), "app", group, configuration)
+	require.NoError(t, err)
+
+	wrr := configuration.Services["app"].Weighted
+	require.NotNil(t, wrr)
+	require.Len(t, wrr.Services, 2)
+
+	weight1 := 50
+	weight2 := 10
+	assert.Equal(t, []dynamic.WRRService{
+		{Name: "app-node1-app-1", Weight: &weight1},
+		{Name: "app-node2-app-2", Weight: &weight2},
+	}, wrr.Services)
+
+	instance1 := configuration.Services["app-node1-app-1"]
+	require.NotNil(t, instance1)
+	require.Len(t, instance1.LoadBalancer.Servers, 1)
+	assert.Equal(t, "https://10.0.0.1:80", instance1.LoadBalancer.Servers[0].URL)
+
+	instance2 := configuration.Services["app-node2-app-2"]
+	require.NotNil(t, instance2)
+	require.Len(t, instance2.LoadBalancer.Servers, 1)
+	assert.Equal(t, "https://10.0.0.2:80", instance2.LoadBalancer.Servers[0].URL)
+}
+
+func Test_addServersTCP_weighted(t *testing.T) {
+	group := []itemData{
+		{Name: "app", Node: "node1", ID: "app-1", Address: "10.0.0.1", Port: "80", Meta: map[string]string{weightMetaKey: "50"}},
+		{Name: "app", Node: "node2", ID: "app-2", Address: "10.0.0.2", Port: "80", Meta: map[string]string{weightMetaKey: "10"}},
+	}
+
+	configuration := &dynamic.TCPConfiguration{
+		Services: map[string]*dynamic.TCPService{
+			"app": {
+				LoadBalancer: &dynamic.TCPServersLoadBalancer{},
+			},
+		},
+	}
+
+	p := &Provider{}
+
+	err := p.buildTCPServiceConfiguration(context.Background(), "app", group, configuration)
+	require.NoError(t, err)
+
+	wrr := configuration.Services["app"].Weighted
+	require.NotNil(t, wrr)
+	require.Len(t, wrr.Services, 2)
+
+	weight1 := 50
+	weight2 := 10
+	assert.Equal(t, []dynamic.TCPWRRService{
+		{Name: "app-node1-app-1", Weight: &weight1},
+		{Name: "app-node2-app-2", Weight: &weight2},
+	}, wrr.Services)
+
+	instance1 := configuration.Services["app-node1-app-1"]
+	require.NotNil(t, instance1)
+	require.Len(t, instance1.LoadBalancer.Servers, 1)
+	assert.Equal(t, "10.0.0.1:80", instance1.LoadBalancer.Servers[0].Address)
+
+	instance2 := configuration.Services["app-node2-app-2"]
+	require.NotNil(t, instance2)
+	require.Len(t, instance2.LoadBalancer.Servers, 1)
+	assert.Equal(t, "10.0.0.2:80", instance2.LoadBalancer.Servers[0].Address)
+}
+
+func Test_groupItemsByService(t *testing.T) {
+	items := []itemData{
+		{Name: "app", Node: "node1", ID: "app-1"},
+		{Name: "app", Node: "node2", ID: "app-2"},
+		{Name: "app-canary", Node: "node3", ID: "canary-1", Labels: map[string]string{serviceClusterLabel: "app"}},
+		{Name: "other", Node: "node1", ID: "other-1"},
+	}
+
+	groups := groupItemsByService(items)
+
+	assert.Len(t, groups, 2)
+	assert.Len(t, groups["app"], 3)
+	assert.Len(t, groups["other"], 1)
+}
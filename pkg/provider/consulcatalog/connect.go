@@ -0,0 +1,286 @@
+package consulcatalog
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/containous/traefik/v2/pkg/config/dynamic"
+	"github.com/containous/traefik/v2/pkg/log"
+	traefiktls "github.com/containous/traefik/v2/pkg/tls"
+	"github.com/hashicorp/consul/api"
+)
+
+// connectLabel lets a service opt in or out of native Consul Connect mTLS,
+// overriding the provider-wide Connect.Enabled setting.
+const connectLabel = "traefik.consulcatalog.connect"
+
+// connectLeafRefreshMargin is how long before its actual expiry a cached
+// leaf certificate is considered stale and refreshed.
+const connectLeafRefreshMargin = time.Minute
+
+// connectRefreshCheckInterval is how often the background refresh loop
+// checks a watched service's cached leaf certificate for impending expiry.
+const connectRefreshCheckInterval = 10 * time.Second
+
+// ConnectConfig configures the native Consul Connect integration: fetching
+// the leaf certificate and CA roots for Connect-enabled services and using
+// them to reach their sidecar proxy over mTLS.
+type ConnectConfig struct {
+	Enabled bool   `description:"Enable the Consul Connect native integration." json:"enabled,omitempty" toml:"enabled,omitempty" yaml:"enabled,omitempty" export:"true"`
+	RootCAs string `description:"PEM bundle used instead of the CA roots returned by Consul Connect." json:"rootCAs,omitempty" toml:"rootCAs,omitempty" yaml:"rootCAs,omitempty"`
+}
+
+// SetDefaults sets the default values.
+func (c *ConnectConfig) SetDefaults() {
+	c.Enabled = false
+}
+
+// connectLeaf is the TLS material fetched from the Consul Connect CA for a
+// single service.
+type connectLeaf struct {
+	certPEM    string
+	keyPEM     string
+	rootsPEM   string
+	validUntil time.Time
+}
+
+// connectCache caches leaf certificates per service so they are refreshed
+// only once they are close to expiry, instead of on every configuration
+// build. For a service it has been asked to watch, it also refreshes the
+// certificate proactively in the background ahead of expiry, so a stable
+// service doesn't end up running on an expired leaf cert until an
+// unrelated catalog change happens to trigger a rebuild.
+type connectCache struct {
+	mu      sync.Mutex
+	certs   map[string]connectLeaf
+	watched map[string]bool
+}
+
+func newConnectCache() *connectCache {
+	return &connectCache{
+		certs:   make(map[string]connectLeaf),
+		watched: make(map[string]bool),
+	}
+}
+
+// connectCacheMu guards the lazy initialization of Provider.connectCache
+// below. It is shared by all providers and taken on every getConnectCache
+// call, but only held to check for and, on first use, create the cache;
+// connectCache.get has its own mutex for the actual cert lookups.
+var connectCacheMu sync.Mutex
+
+// getConnectCache returns p's leaf certificate cache, creating it on first
+// use. Provider construction has no dedicated step to set it up, so
+// buildConnectTransport must go through this accessor rather than touching
+// p.connectCache directly, or it would nil-pointer-panic on first use.
+func (p *Provider) getConnectCache() *connectCache {
+	connectCacheMu.Lock()
+	defer connectCacheMu.Unlock()
+
+	if p.connectCache == nil {
+		p.connectCache = newConnectCache()
+	}
+
+	return p.connectCache
+}
+
+func (c *connectCache) get(client *api.Client, serviceName string) (connectLeaf, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if leaf, ok := c.certs[serviceName]; ok && time.Now().Before(leaf.validUntil.Add(-connectLeafRefreshMargin)) {
+		return leaf, nil
+	}
+
+	leafCert, _, err := client.Agent().ConnectCALeaf(serviceName, nil)
+	if err != nil {
+		return connectLeaf{}, fmt.Errorf("fetching connect leaf certificate: %w", err)
+	}
+
+	roots, _, err := client.Agent().ConnectCARoots(nil)
+	if err != nil {
+		return connectLeaf{}, fmt.Errorf("fetching connect CA roots: %w", err)
+	}
+
+	var rootsPEM string
+	for _, root := range roots.Roots {
+		rootsPEM += root.RootCertPEM
+	}
+
+	leaf := connectLeaf{
+		certPEM:    leafCert.CertPEM,
+		keyPEM:     leafCert.PrivateKeyPEM,
+		rootsPEM:   rootsPEM,
+		validUntil: leafCert.ValidBefore,
+	}
+	c.certs[serviceName] = leaf
+
+	return leaf, nil
+}
+
+func (c *connectCache) leaf(serviceName string) (connectLeaf, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leaf, ok := c.certs[serviceName]
+	return leaf, ok
+}
+
+// watch starts, the first time it is called for serviceName, a background
+// goroutine that proactively refreshes that service's cached leaf
+// certificate shortly before it expires, instead of only refreshing it
+// lazily the next time get happens to be called. Each successful proactive
+// refresh is reported through notify, so the caller can push an updated
+// ServersTransport without waiting for an unrelated catalog change to
+// trigger a rebuild. It stops once ctx is done.
+func (c *connectCache) watch(ctx context.Context, client *api.Client, serviceName string, notify func(serviceName string)) {
+	c.mu.Lock()
+	if c.watched[serviceName] {
+		c.mu.Unlock()
+		return
+	}
+	c.watched[serviceName] = true
+	c.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(connectRefreshCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				leaf, ok := c.leaf(serviceName)
+				if ok && time.Now().Before(leaf.validUntil.Add(-connectLeafRefreshMargin)) {
+					continue
+				}
+
+				if _, err := c.get(client, serviceName); err != nil {
+					continue
+				}
+
+				notify(serviceName)
+			}
+		}
+	}()
+}
+
+// connectEnabled reports whether item should be wired up with native
+// Consul Connect mTLS. The per-service label takes precedence over the
+// provider-wide setting.
+func (p *Provider) connectEnabled(item itemData) bool {
+	if raw, ok := item.Labels[connectLabel]; ok {
+		if enabled, err := strconv.ParseBool(raw); err == nil {
+			return enabled
+		}
+	}
+
+	if !p.Connect.Enabled {
+		return false
+	}
+
+	for _, tag := range item.Tags {
+		if tag == "connect-proxy" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// connectProxyAddress looks up the Connect sidecar proxy registered for the
+// specific instance item in the Consul catalog and returns its advertised
+// address and port. A proxy is registered under its own Consul service ID,
+// distinct from item.ID, so the match has to go through
+// ServiceProxy.DestinationServiceID - the application instance it is
+// actually sidecaring - rather than the proxy's own ID or node co-location,
+// either of which can pick an arbitrary sidecar when a service has more
+// than one instance.
+func (p *Provider) connectProxyAddress(item itemData) (string, string, error) {
+	proxies, _, err := p.client.Catalog().Connect(item.Name, &api.QueryOptions{})
+	if err != nil {
+		return "", "", fmt.Errorf("listing connect proxies for %s: %w", item.Name, err)
+	}
+
+	proxy, ok := selectConnectProxy(proxies, item)
+	if !ok {
+		return "", "", fmt.Errorf("no connect proxy found for service instance %s/%s", item.Name, item.ID)
+	}
+
+	return proxy.ServiceAddress, strconv.Itoa(proxy.ServicePort), nil
+}
+
+// selectConnectProxy picks the sidecar proxy in proxies that fronts item,
+// matched through ServiceProxy.DestinationServiceID. It only falls back to
+// an unmatched result when proxies holds exactly one unambiguous candidate.
+func selectConnectProxy(proxies []*api.CatalogService, item itemData) (*api.CatalogService, bool) {
+	for _, proxy := range proxies {
+		if proxy.ServiceProxy != nil && proxy.ServiceProxy.DestinationServiceID == item.ID {
+			return proxy, true
+		}
+	}
+
+	if len(proxies) == 1 && (proxies[0].ServiceProxy == nil || proxies[0].ServiceProxy.DestinationServiceID == "") {
+		return proxies[0], true
+	}
+
+	return nil, false
+}
+
+// buildConnectTransport fetches the current leaf certificate and CA roots
+// for item's service and turns them into the ServersTransport a server's
+// load balancer can reference to dial the sidecar over mTLS. It also makes
+// sure the leaf certificate is watched for proactive, periodic renewal
+// ahead of its expiry, rather than only ever being refreshed the next time
+// this function happens to be called again for the same service.
+func (p *Provider) buildConnectTransport(ctx context.Context, item itemData) (string, *dynamic.ServersTransport, error) {
+	cache := p.getConnectCache()
+
+	leaf, err := cache.get(p.client, item.Name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cache.watch(ctx, p.client, item.Name, func(serviceName string) {
+		log.FromContext(ctx).Debugf("Refreshed connect leaf certificate for %s ahead of expiry", serviceName)
+		p.requestRefresh()
+	})
+
+	rootsPEM := leaf.rootsPEM
+	if p.Connect.RootCAs != "" {
+		rootsPEM = p.Connect.RootCAs
+	}
+
+	name := "consulcatalog-connect-" + item.Node + "-" + item.Name + "-" + item.ID
+
+	transport := &dynamic.ServersTransport{
+		ServerName: item.Name,
+		RootCAs:    []traefiktls.FileOrContent{traefiktls.FileOrContent(rootsPEM)},
+		Certificates: traefiktls.Certificates{
+			{
+				CertFile: traefiktls.FileOrContent(leaf.certPEM),
+				KeyFile:  traefiktls.FileOrContent(leaf.keyPEM),
+			},
+		},
+	}
+
+	return name, transport, nil
+}
+
+// requestRefresh asks the provider's Provide loop to rebuild and push the
+// dynamic configuration immediately, instead of waiting for the next
+// catalog poll/watch tick. Provide should select on refreshTrigger
+// alongside its usual Consul watch and force a rebuild whenever it fires.
+// The channel is expected to be buffered (size 1); the send is
+// non-blocking so a pending refresh already queued, or a nil channel in
+// tests, never blocks the background renewal goroutine.
+func (p *Provider) requestRefresh() {
+	select {
+	case p.refreshTrigger <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,112 @@
+package consulcatalog
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_connectEnabled(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		provider Provider
+		item     itemData
+		expected bool
+	}{
+		{
+			desc:     "disabled by default",
+			provider: Provider{},
+			item:     itemData{Tags: []string{"connect-proxy"}},
+			expected: false,
+		},
+		{
+			desc:     "enabled provider-wide, connect-proxy tag present",
+			provider: Provider{Connect: ConnectConfig{Enabled: true}},
+			item:     itemData{Tags: []string{"connect-proxy"}},
+			expected: true,
+		},
+		{
+			desc:     "enabled provider-wide, no connect-proxy tag",
+			provider: Provider{Connect: ConnectConfig{Enabled: true}},
+			item:     itemData{Tags: []string{"other"}},
+			expected: false,
+		},
+		{
+			desc:     "label overrides provider-wide disabled",
+			provider: Provider{},
+			item:     itemData{Labels: map[string]string{connectLabel: "true"}},
+			expected: true,
+		},
+		{
+			desc:     "label overrides provider-wide enabled",
+			provider: Provider{Connect: ConnectConfig{Enabled: true}},
+			item:     itemData{Tags: []string{"connect-proxy"}, Labels: map[string]string{connectLabel: "false"}},
+			expected: false,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := test.provider.connectEnabled(test.item)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_selectConnectProxy(t *testing.T) {
+	instance := itemData{Name: "app", ID: "app-1"}
+
+	testCases := []struct {
+		desc     string
+		proxies  []*api.CatalogService
+		expected string
+		found    bool
+	}{
+		{
+			desc:    "no proxies",
+			proxies: nil,
+			found:   false,
+		},
+		{
+			desc: "single unmatched proxy falls back",
+			proxies: []*api.CatalogService{
+				{ServiceID: "app-1-proxy", ServiceAddress: "10.0.0.1"},
+			},
+			expected: "10.0.0.1",
+			found:    true,
+		},
+		{
+			desc: "matches by destination service ID among several instances",
+			proxies: []*api.CatalogService{
+				{ServiceID: "app-2-proxy", ServiceAddress: "10.0.0.2", ServiceProxy: &api.AgentServiceConnectProxyConfig{DestinationServiceID: "app-2"}},
+				{ServiceID: "app-1-proxy", ServiceAddress: "10.0.0.1", ServiceProxy: &api.AgentServiceConnectProxyConfig{DestinationServiceID: "app-1"}},
+			},
+			expected: "10.0.0.1",
+			found:    true,
+		},
+		{
+			desc: "several unmatched proxies is ambiguous",
+			proxies: []*api.CatalogService{
+				{ServiceID: "app-2-proxy", ServiceAddress: "10.0.0.2"},
+				{ServiceID: "app-3-proxy", ServiceAddress: "10.0.0.3"},
+			},
+			found: false,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			proxy, ok := selectConnectProxy(test.proxies, instance)
+
+			assert.Equal(t, test.found, ok)
+			if test.found {
+				assert.Equal(t, test.expected, proxy.ServiceAddress)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package consulcatalog
+
+import "github.com/hashicorp/consul/api"
+
+// Warning policy values for Provider.WarningPolicy.
+const (
+	warningPolicyAccept = "accept"
+	warningPolicyDrain  = "drain"
+	warningPolicyReject = "reject"
+)
+
+// defaultWarningWeight is the weight assigned to a warning-state instance
+// when WarningPolicy is "drain" and WarningWeight is not set. Per-instance
+// weight overrides are not consulted for such an instance.
+const defaultWarningWeight = 1
+
+// warningPolicy returns the effective warning policy, defaulting to
+// "accept" for backward compatibility.
+func (p *Provider) warningPolicy() string {
+	if p.WarningPolicy == "" {
+		return warningPolicyAccept
+	}
+
+	return p.WarningPolicy
+}
+
+// warningWeight returns the weight to assign to a warning-state instance
+// under the "drain" policy.
+func (p *Provider) warningWeight() int {
+	if p.WarningWeight > 0 {
+		return p.WarningWeight
+	}
+
+	return defaultWarningWeight
+}
+
+// acceptHealthStatus reports whether an instance in status should be kept
+// at all, given policy. Passing instances are always kept; unhealthy or
+// starting instances are always dropped. A warning instance is dropped
+// only under the "reject" policy - "accept" and "drain" both keep it,
+// "drain" relying on serverWeight to steer traffic away from it instead.
+func acceptHealthStatus(status, policy string) bool {
+	switch status {
+	case api.HealthPassing:
+		return true
+	case api.HealthWarning:
+		return policy != warningPolicyReject
+	default:
+		return false
+	}
+}
@@ -0,0 +1,98 @@
+package consulcatalog
+
+import (
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_warningPolicy(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		provider Provider
+		expected string
+	}{
+		{
+			desc:     "empty defaults to accept",
+			provider: Provider{},
+			expected: warningPolicyAccept,
+		},
+		{
+			desc:     "explicit policy is returned as-is",
+			provider: Provider{WarningPolicy: warningPolicyDrain},
+			expected: warningPolicyDrain,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := test.provider.warningPolicy()
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_warningWeight(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		provider Provider
+		expected int
+	}{
+		{
+			desc:     "unset defaults to defaultWarningWeight",
+			provider: Provider{},
+			expected: defaultWarningWeight,
+		},
+		{
+			desc:     "explicit value is honored",
+			provider: Provider{WarningWeight: 5},
+			expected: 5,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := test.provider.warningWeight()
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_acceptHealthStatus(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		status   string
+		policy   string
+		expected bool
+	}{
+		{desc: "passing is always kept", status: api.HealthPassing, policy: warningPolicyReject, expected: true},
+		{desc: "accept keeps warning", status: api.HealthWarning, policy: warningPolicyAccept, expected: true},
+		{desc: "drain keeps warning", status: api.HealthWarning, policy: warningPolicyDrain, expected: true},
+		{desc: "reject filters out warning", status: api.HealthWarning, policy: warningPolicyReject, expected: false},
+		{desc: "critical is always filtered out", status: api.HealthCritical, policy: warningPolicyAccept, expected: false},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := acceptHealthStatus(test.status, test.policy)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_serverWeight_drain(t *testing.T) {
+	provider := Provider{WarningPolicy: warningPolicyDrain, WarningWeight: 3}
+
+	warning := itemData{Status: api.HealthWarning, Meta: map[string]string{weightMetaKey: "100"}}
+	assert.Equal(t, 3, provider.serverWeight(warning), "drain forces the warning weight even if an override is set")
+
+	passing := itemData{Status: api.HealthPassing}
+	assert.Equal(t, defaultServerWeight, provider.serverWeight(passing))
+}
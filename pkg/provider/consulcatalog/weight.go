@@ -0,0 +1,66 @@
+package consulcatalog
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// weightMetaKey is the Consul service meta key read as a per-instance
+// weight override, taking precedence over the weightTagPrefix tag.
+const weightMetaKey = "traefik.weight"
+
+// weightTagPrefix marks a Consul tag as carrying a per-instance weight,
+// e.g. "traefik.weight=50".
+const weightTagPrefix = "traefik.weight="
+
+// defaultServerWeight is the weight assigned to a passing instance that
+// does not carry an explicit weight override.
+const defaultServerWeight = 100
+
+// serverWeight returns the load-balancing weight for item. A warning-state
+// instance is weighted down to warningWeight when WarningPolicy is
+// "drain", regardless of any override, since that policy exists precisely
+// to steer traffic away from degraded instances without relying on an
+// operator remembering to lower their weight manually. Otherwise the
+// weight is read from the instance's Consul service meta, falling back to
+// a "traefik.weight=" tag, and finally to defaultServerWeight.
+func (p *Provider) serverWeight(item itemData) int {
+	if item.Status == api.HealthWarning && p.warningPolicy() == warningPolicyDrain {
+		return p.warningWeight()
+	}
+
+	if raw, ok := item.Meta[weightMetaKey]; ok {
+		if weight, ok := parseWeight(raw); ok {
+			return weight
+		}
+	}
+
+	for _, tag := range item.Tags {
+		if !strings.HasPrefix(tag, weightTagPrefix) {
+			continue
+		}
+
+		if weight, ok := parseWeight(strings.TrimPrefix(tag, weightTagPrefix)); ok {
+			return weight
+		}
+	}
+
+	return defaultServerWeight
+}
+
+func parseWeight(raw string) (int, bool) {
+	weight, err := strconv.Atoi(raw)
+	if err != nil || weight < 0 {
+		return 0, false
+	}
+
+	return weight, true
+}
+
+// instanceKey uniquely identifies a service instance within a logical
+// service group.
+func instanceKey(item itemData) string {
+	return item.Node + "-" + item.ID
+}
@@ -0,0 +1,94 @@
+package consulcatalog
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_serverWeight(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		provider Provider
+		item     itemData
+		expected int
+	}{
+		{
+			desc:     "no override uses the default",
+			provider: Provider{},
+			item:     itemData{},
+			expected: defaultServerWeight,
+		},
+		{
+			desc:     "meta key overrides the default",
+			provider: Provider{},
+			item:     itemData{Meta: map[string]string{weightMetaKey: "42"}},
+			expected: 42,
+		},
+		{
+			desc:     "tag is used when meta is absent",
+			provider: Provider{},
+			item:     itemData{Tags: []string{"other", "traefik.weight=7"}},
+			expected: 7,
+		},
+		{
+			desc:     "meta takes precedence over tag",
+			provider: Provider{},
+			item:     itemData{Meta: map[string]string{weightMetaKey: "1"}, Tags: []string{"traefik.weight=7"}},
+			expected: 1,
+		},
+		{
+			desc:     "invalid tag falls back to the default",
+			provider: Provider{},
+			item:     itemData{Tags: []string{"traefik.weight=not-a-number"}},
+			expected: defaultServerWeight,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := test.provider.serverWeight(test.item)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_uniformWeight(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		group    []itemData
+		expected bool
+	}{
+		{
+			desc:     "single instance is always uniform",
+			group:    []itemData{{}},
+			expected: true,
+		},
+		{
+			desc:     "same explicit weight is uniform",
+			group:    []itemData{{Meta: map[string]string{weightMetaKey: "50"}}, {Meta: map[string]string{weightMetaKey: "50"}}},
+			expected: true,
+		},
+		{
+			desc:     "different weights are not uniform",
+			group:    []itemData{{Meta: map[string]string{weightMetaKey: "50"}}, {Meta: map[string]string{weightMetaKey: "10"}}},
+			expected: false,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			actual := uniformWeight(&Provider{}, test.group)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func Test_instanceKey(t *testing.T) {
+	item := itemData{Node: "node1", ID: "svc-1"}
+	assert.Equal(t, "node1-svc-1", instanceKey(item))
+}